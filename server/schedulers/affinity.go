@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/pingcap/log"
@@ -18,12 +20,70 @@ import (
 )
 
 const (
-	// LabelName is label scheduler name.
+	// AffinityName is affinity scheduler name.
 	AffinityName = "affinity-scheduler"
-	// LabelType is label scheduler type.
+	// AffinityType is affinity scheduler type.
 	AffinityType = "affinity"
 )
 
+// TargetPolicy decides where a range's leaders should end up. Some
+// policies carry an argument after a colon, e.g. "pin:3" or
+// "label:zone=z1".
+type TargetPolicy string
+
+const (
+	// PolicyConcentrate moves every leader in the range onto the store
+	// that already holds the most of them. This is the original affinity
+	// scheduler behavior.
+	PolicyConcentrate = "concentrate"
+	// PolicyPin forces every leader in the range onto a specific store,
+	// e.g. "pin:3".
+	PolicyPin = "pin"
+	// PolicyLabel moves leaders onto a store whose label matches "k=v",
+	// breaking ties by current leader count, e.g. "label:zone=z1". Only
+	// matching stores are candidates: when none matches, no leader in the
+	// range is moved.
+	PolicyLabel = "label"
+	// PolicySpread is the inverse of concentrate: it moves leaders off the
+	// store with the most of them onto the store with the fewest.
+	PolicySpread = "spread"
+)
+
+// kind returns the policy name, stripping any ":arg" suffix.
+func (p TargetPolicy) kind() string {
+	if i := strings.IndexByte(string(p), ':'); i >= 0 {
+		return string(p)[:i]
+	}
+	return string(p)
+}
+
+// arg returns the ":arg" suffix of the policy, or "" if there is none.
+func (p TargetPolicy) arg() string {
+	if i := strings.IndexByte(string(p), ':'); i >= 0 {
+		return string(p)[i+1:]
+	}
+	return ""
+}
+
+func validatePolicy(policy TargetPolicy) error {
+	switch policy.kind() {
+	case PolicyConcentrate, PolicySpread:
+		return nil
+	case PolicyPin:
+		if _, err := strconv.ParseUint(policy.arg(), 10, 64); err != nil {
+			return errs.ErrSchedulerConfig.FastGenByArgs("affinity pin store id " + policy.arg())
+		}
+		return nil
+	case PolicyLabel:
+		if !strings.Contains(policy.arg(), "=") {
+			return errs.ErrSchedulerConfig.FastGenByArgs("affinity label " + policy.arg())
+		}
+		return nil
+	default:
+		return errs.ErrSchedulerConfig.FastGenByArgs("affinity policy " + string(policy))
+	}
+}
+
 func init() {
 	schedule.RegisterSliceDecoderBuilder(AffinityType, func(args []string) schedule.ConfigDecoder {
 		return func(v interface{}) error {
@@ -34,11 +94,11 @@ func init() {
 			if len(args) == 0 {
 				return errs.ErrSchedulerConfig.FastGenByArgs("affinity args")
 			}
-			ranges, err := getKeyRanges(args)
+			ranges, err := parseRangePolicies(args)
 			if err != nil {
 				return err
 			}
-			conf.Range = ranges[0]
+			conf.Ranges = ranges
 
 			return nil
 		}
@@ -54,9 +114,50 @@ func init() {
 	})
 }
 
+// parseRangePolicies parses "start,end,policy[,arg]" tuples, one per
+// element of args, where start/end are hex-encoded keys. The policy's
+// argument may be given inline ("pin:3") or as a trailing field
+// ("pin,3") since `,` already separates the range bounds.
+func parseRangePolicies(args []string) ([]rangePolicyConfig, error) {
+	ranges := make([]rangePolicyConfig, 0, len(args))
+	for _, arg := range args {
+		fields := strings.Split(arg, ",")
+		if len(fields) < 3 {
+			return nil, errs.ErrSchedulerConfig.FastGenByArgs("affinity range " + arg)
+		}
+		start, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, errs.ErrSchedulerConfig.FastGenByArgs("affinity range start " + fields[0])
+		}
+		end, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, errs.ErrSchedulerConfig.FastGenByArgs("affinity range end " + fields[1])
+		}
+		policy := TargetPolicy(fields[2])
+		if len(fields) > 3 {
+			policy = TargetPolicy(fields[2] + ":" + strings.Join(fields[3:], ","))
+		}
+		if err := validatePolicy(policy); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, rangePolicyConfig{
+			KeyRange: core.NewKeyRange(string(start), string(end)),
+			Policy:   policy,
+		})
+	}
+	return ranges, nil
+}
+
+// rangePolicyConfig binds a key range to the policy used to place its
+// leaders.
+type rangePolicyConfig struct {
+	core.KeyRange
+	Policy TargetPolicy `json:"policy"`
+}
+
 type affinitySchedulerConfig struct {
-	name  string
-	Range core.KeyRange `json:"range"`
+	name   string
+	Ranges []rangePolicyConfig `json:"ranges"`
 }
 
 type affinityScheduler struct {
@@ -96,13 +197,82 @@ func (s *affinityScheduler) IsScheduleAllowed(cluster opt.Cluster) bool {
 	return allowed
 }
 
-func targetStore(store_leadernum *map[uint64]uint64) uint64 {
-	if len(*store_leadernum) == 0 {
+// targetPlan describes which store a range's leaders should move to, and
+// which source stores that applies to. A zero source means every store
+// other than target is a source; spread sets source to the single store
+// that should shed its leaders.
+type targetPlan struct {
+	target uint64
+	source uint64
+}
+
+func (p targetPlan) shouldMove(storeID uint64) bool {
+	if storeID == p.target {
+		return false
+	}
+	if p.source == 0 {
+		return true
+	}
+	return storeID == p.source
+}
+
+// selectTarget dispatches on policy to decide where a range's leaders
+// should be concentrated, pinned, labeled or spread. storeLeaderNum must
+// cover every store holding a peer in the range, including ones with zero
+// leaders there, so label and spread can target an idle store.
+func selectTarget(policy TargetPolicy, cluster opt.Cluster, storeLeaderNum map[uint64]uint64) (targetPlan, error) {
+	switch policy.kind() {
+	case PolicyPin:
+		storeID, err := strconv.ParseUint(policy.arg(), 10, 64)
+		if err != nil {
+			return targetPlan{}, errs.ErrSchedulerConfig.FastGenByArgs("affinity pin store id " + policy.arg())
+		}
+		return targetPlan{target: storeID}, nil
+	case PolicyLabel:
+		kv := strings.SplitN(policy.arg(), "=", 2)
+		if len(kv) != 2 {
+			return targetPlan{}, errs.ErrSchedulerConfig.FastGenByArgs("affinity label " + policy.arg())
+		}
+		target, ok := labelTarget(cluster, storeLeaderNum, kv[0], kv[1])
+		if !ok {
+			return targetPlan{}, errs.ErrSchedulerConfig.FastGenByArgs("affinity label " + policy.arg() + " matches no store")
+		}
+		return targetPlan{target: target}, nil
+	case PolicySpread:
+		max, min := maxMinStore(storeLeaderNum)
+		return targetPlan{target: min, source: max}, nil
+	default:
+		return targetPlan{target: maxStore(storeLeaderNum)}, nil
+	}
+}
+
+// labelTarget returns the store among storeLeaderNum (which may include
+// stores with zero leaders) whose label key equals val, preferring the
+// one with the most leaders already (ties broken by the smallest store
+// id, as concentrate does).
+func labelTarget(cluster opt.Cluster, storeLeaderNum map[uint64]uint64, key, val string) (uint64, bool) {
+	var target uint64
+	var max uint64
+	found := false
+	for storeID, count := range storeLeaderNum {
+		store := cluster.GetStore(storeID)
+		if store == nil || store.GetLabelValue(key) != val {
+			continue
+		}
+		if !found || count > max || (count == max && storeID < target) {
+			target, max, found = storeID, count, true
+		}
+	}
+	return target, found
+}
+
+func maxStore(storeLeaderNum map[uint64]uint64) uint64 {
+	if len(storeLeaderNum) == 0 {
 		panic("store_leaders is empty")
 	}
 	var max uint64 = 0
 	var maxstore uint64 = 0
-	for storeid, count := range *store_leadernum {
+	for storeid, count := range storeLeaderNum {
 		if count > max {
 			max = count
 			maxstore = storeid
@@ -114,25 +284,68 @@ func targetStore(store_leadernum *map[uint64]uint64) uint64 {
 	return maxstore
 }
 
+// maxMinStore returns the store with the most leaders and the store with
+// the fewest, both tie-broken by the smallest store id. storeLeaderNum
+// may include stores with zero leaders, which is what lets spread move
+// leaders onto a genuinely idle store instead of just the least-loaded
+// one that already has a leader.
+func maxMinStore(storeLeaderNum map[uint64]uint64) (maxStoreID, minStoreID uint64) {
+	if len(storeLeaderNum) == 0 {
+		panic("store_leaders is empty")
+	}
+	first := true
+	var max, min uint64
+	for storeID, count := range storeLeaderNum {
+		if first || count > max || (count == max && storeID < maxStoreID) {
+			max, maxStoreID = count, storeID
+		}
+		if first || count < min || (count == min && storeID < minStoreID) {
+			min, minStoreID = count, storeID
+		}
+		first = false
+	}
+	return
+}
+
 func (s *affinityScheduler) Schedule(cluster opt.Cluster) []*operator.Operator {
 	schedulerCounter.WithLabelValues(s.GetName(), "schedule").Inc()
-	store_leadernum := make(map[uint64]uint64)
-	regions := cluster.ScanRegions(s.conf.Range.StartKey, s.conf.Range.EndKey, 0)
+
+	ops := make([]*operator.Operator, 0)
+	for _, rc := range s.conf.Ranges {
+		ops = append(ops, s.scheduleRange(cluster, rc)...)
+	}
+	return ops
+}
+
+func (s *affinityScheduler) scheduleRange(cluster opt.Cluster, rc rangePolicyConfig) []*operator.Operator {
+	// storeLeaderNum is the leader-placement candidate set: every store
+	// that holds a peer of a region in the range, not just the ones that
+	// already have a leader there. Stores with zero leaders must still be
+	// selectable, otherwise label/spread can never move a leader onto a
+	// store that hasn't held one yet.
+	storeLeaderNum := make(map[uint64]uint64)
+	regions := cluster.ScanRegions(rc.StartKey, rc.EndKey, 0)
 
 	haveLeaderCount := 0
 	for _, region := range regions {
-		if !isInvolved(region, s.conf.Range.StartKey, s.conf.Range.EndKey) {
+		if !isInvolved(region, rc.StartKey, rc.EndKey) {
 			log.Debug(fmt.Sprintf("region %d not involved  start:%s end:%s ,conf start:%s, end:%s",
 				region.GetID(), hex.EncodeToString(region.GetStartKey()), hex.EncodeToString(region.GetEndKey()),
-				hex.EncodeToString(s.conf.Range.StartKey), hex.EncodeToString(s.conf.Range.EndKey)))
+				hex.EncodeToString(rc.StartKey), hex.EncodeToString(rc.EndKey)))
 			continue
 		}
 
+		for _, peer := range region.GetPeers() {
+			if _, ok := storeLeaderNum[peer.StoreId]; !ok {
+				storeLeaderNum[peer.StoreId] = 0
+			}
+		}
+
 		l := region.GetLeader()
 		if l != nil && region.GetDownPeer(l.Id) == nil {
 			haveLeaderCount = haveLeaderCount + 1
 			storeid := l.StoreId
-			store_leadernum[storeid] = store_leadernum[storeid] + 1
+			storeLeaderNum[storeid] = storeLeaderNum[storeid] + 1
 		}
 	}
 	if haveLeaderCount == 0 {
@@ -140,27 +353,37 @@ func (s *affinityScheduler) Schedule(cluster opt.Cluster) []*operator.Operator {
 		return nil
 	}
 
-	targetstore := targetStore(&store_leadernum)
+	plan, err := selectTarget(rc.Policy, cluster, storeLeaderNum)
+	if err != nil {
+		log.Warn(fmt.Sprintf("fail to select affinity target, start:%s end:%s policy:%s",
+			hex.EncodeToString(rc.StartKey), hex.EncodeToString(rc.EndKey), rc.Policy), errs.ZapError(err))
+		return nil
+	}
 
 	ops := make([]*operator.Operator, 0)
 	for _, region := range regions {
 		l := region.GetLeader()
-		if l == nil {
+		if l == nil || !plan.shouldMove(l.StoreId) {
 			continue
 		}
-		if targetstore != l.StoreId {
-			op, err := operator.CreateTransferLeaderOperator(
-				fmt.Sprintf("from affinity controller, r %d ", region.GetID()), cluster, region,
-				l.StoreId, targetstore, operator.OpLeader)
-			if err != nil {
-				log.Warn(fmt.Sprintf("fail to create transfer leader operator, region:%d from %d to %d ",
-					region.GetID(), l.StoreId, targetstore), errs.ZapError(err))
-				return nil
-			}
-			op.Counters = append(op.Counters, schedulerCounter.WithLabelValues(s.GetName(), "new-operator"))
-			ops = append(ops, op)
+		if region.GetStorePeer(plan.target) == nil {
+			// e.g. a pin/label target that doesn't hold a peer of this
+			// particular region. Skip it rather than let
+			// CreateTransferLeaderOperator fail below.
+			log.Debug(fmt.Sprintf("skip region %d, target store %d is not one of its peers",
+				region.GetID(), plan.target))
+			continue
 		}
-
+		op, err := operator.CreateTransferLeaderOperator(
+			fmt.Sprintf("from affinity controller, r %d ", region.GetID()), cluster, region,
+			l.StoreId, plan.target, operator.OpLeader)
+		if err != nil {
+			log.Warn(fmt.Sprintf("fail to create transfer leader operator, region:%d from %d to %d ",
+				region.GetID(), l.StoreId, plan.target), errs.ZapError(err))
+			continue
+		}
+		op.Counters = append(op.Counters, schedulerCounter.WithLabelValues(s.GetName(), "new-operator"))
+		ops = append(ops, op)
 	}
 
 	return ops
@@ -197,12 +420,26 @@ func (l *affinityScheduler) handleSetConfig(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	if v, ok := m["range"]; ok {
+	if v, ok := m["ranges"]; ok {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			rd.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
 
-		if err := json.Unmarshal([]byte(v.(string)), &l.conf.Range); err != nil {
+		var ranges []rangePolicyConfig
+		if err := json.Unmarshal(raw, &ranges); err != nil {
 			rd.JSON(w, http.StatusBadRequest, err.Error())
 			return
 		}
+		for _, rc := range ranges {
+			if err := validatePolicy(rc.Policy); err != nil {
+				rd.JSON(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		l.conf.Ranges = ranges
 
 		if err := l.persist(); err != nil {
 			rd.JSON(w, http.StatusInternalServerError, err.Error())
@@ -1,15 +1,29 @@
 package command
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/tikv/pd/pkg/codec"
 )
 
+// errBatchHadFailures is returned by runBatch when at least one input line
+// failed, so the command exits non-zero without calling os.Exit directly
+// -- pd-ctl can run as a long-lived interactive shell that calls
+// rootCmd.Execute() once per typed command in the same process, and
+// os.Exit from a leaf Run would kill that whole session over one bad
+// line.
+var errBatchHadFailures = errors.New("one or more lines failed, see output above")
+
 // NewLabelCommand return a member subcommand of rootCmd
 func NewKeycodecCommand() *cobra.Command {
 	l := &cobra.Command{
@@ -26,10 +40,16 @@ func NewEncodeCommand() *cobra.Command {
 	l := &cobra.Command{
 		Use:   "encode  <key> [from_hex]",
 		Short: "encode",
-		Run:   encode,
+		RunE:  encode,
 	}
-	l.Flags().BoolP("base64", "b", false, "output base64.")
-	l.Flags().BoolP("url", "q", false, "output url.QueryEscape")
+	l.Flags().BoolP("base64", "b", false, "output base64. (deprecated, use --format base64)")
+	l.Flags().BoolP("url", "q", false, "output url.QueryEscape. (deprecated, use --format url)")
+	l.Flags().MarkDeprecated("base64", "use --format base64 instead")
+	l.Flags().MarkDeprecated("url", "use --format url instead")
+	l.Flags().String("format", "", "output format: hex, base64, url or raw (default hex)")
+	l.Flags().Bool("tidb", false, "build a tidb key: encode --tidb row <tableID> <handle> | encode --tidb index <tableID> <indexID> <value>...")
+	l.Flags().Bool("batch", false, "read keys line-by-line from stdin, emitting one encoded line per input")
+	l.Flags().Bool("json", false, "with --batch, emit one JSON object per line instead of plain text")
 	return l
 }
 
@@ -38,64 +58,292 @@ func NewDecodeCommand() *cobra.Command {
 	l := &cobra.Command{
 		Use:   "decode   <key> ",
 		Short: "decode",
-		Run:   decode,
+		RunE:  decode,
 	}
-	l.Flags().BoolP("base64", "b", false, "from base64.")
+	l.Flags().BoolP("base64", "b", false, "from base64. (deprecated, use --format base64)")
+	l.Flags().MarkDeprecated("base64", "use --format base64 instead")
+	l.Flags().String("format", "", "input format: hex, base64, url or raw (default hex)")
+	l.Flags().Bool("tidb", false, "decode a tidb row/index key into table id, handle/index id and index values")
+	l.Flags().Bool("batch", false, "read keys line-by-line from stdin, emitting one decoded line per input")
+	l.Flags().Bool("json", false, "with --batch, emit one JSON object per line instead of plain text")
 	return l
 }
 
-func encode(cmd *cobra.Command, args []string) {
+// lineResult is the --json shape emitted by --batch mode, one object per
+// input line.
+type lineResult struct {
+	In    string `json:"in"`
+	Out   string `json:"out,omitempty"`
+	Left  string `json:"left,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// resolveFormat reads --format, falling back to the deprecated --base64 /
+// --url bool flags, and finally hex.
+func resolveFormat(cmd *cobra.Command) (string, error) {
+	if format, _ := cmd.Flags().GetString("format"); format != "" {
+		switch format {
+		case "hex", "base64", "url", "raw":
+			return format, nil
+		default:
+			return "", fmt.Errorf("unknown format %q, want hex, base64, url or raw", format)
+		}
+	}
+	if v, _ := cmd.Flags().GetBool("base64"); v {
+		return "base64", nil
+	}
+	if v, _ := cmd.Flags().GetBool("url"); v {
+		return "url", nil
+	}
+	return "hex", nil
+}
+
+func formatOutput(b []byte, format string) string {
+	switch format {
+	case "base64":
+		return base64.StdEncoding.EncodeToString(b)
+	case "url":
+		return url.QueryEscape(string(b))
+	case "raw":
+		return string(b)
+	default:
+		return fmt.Sprintf("%X", b)
+	}
+}
+
+func decodeInput(raw string, format string) ([]byte, error) {
+	switch format {
+	case "base64":
+		return base64.StdEncoding.DecodeString(raw)
+	case "url":
+		s, err := url.QueryUnescape(raw)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	case "raw":
+		return []byte(raw), nil
+	default:
+		return hex.DecodeString(raw)
+	}
+}
+
+// runBatch reads newline-delimited input from in, applies fn to each line
+// in order and prints one line of output per input line. A per-line
+// error never aborts the stream; it is carried in fn's returned
+// lineResult and, once the stream is exhausted, runBatch returns
+// errBatchHadFailures if any line failed, so the caller can fail this one
+// invocation without tearing down the process.
+func runBatch(cmd *cobra.Command, in io.Reader, asJSON bool, fn func(line string) lineResult) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	failed := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		res := fn(line)
+		res.In = line
+		if res.Error != "" {
+			failed = true
+		}
+		if asJSON {
+			out, err := json.Marshal(res)
+			if err != nil {
+				cmd.PrintErrln(err)
+				failed = true
+				continue
+			}
+			cmd.Println(string(out))
+			continue
+		}
+		if res.Error != "" {
+			cmd.PrintErrf("%s: %s\n", line, res.Error)
+			continue
+		}
+		cmd.Println(res.Out)
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.PrintErrln(err)
+		failed = true
+	}
+	if failed {
+		return errBatchHadFailures
+	}
+	return nil
+}
+
+func encode(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	format, err := resolveFormat(cmd)
+	if err != nil {
+		cmd.Println(err)
+		return nil
+	}
+	tidb, _ := cmd.Flags().GetBool("tidb")
+
+	if batch, _ := cmd.Flags().GetBool("batch"); batch {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		return runBatch(cmd, cmd.InOrStdin(), asJSON, func(line string) lineResult {
+			if tidb {
+				return encodeTiDBLine(strings.Fields(line), format)
+			}
+			return lineResult{Out: formatOutput(codec.EncodeBytes([]byte(line)), format)}
+		})
+	}
+
+	if tidb {
+		encodeTiDB(cmd, args, format)
+		return nil
+	}
+
 	if len(args) < 1 {
 		cmd.Println(cmd.UsageString())
-		return
+		return nil
 	}
-	var err error
 	key := []byte(args[0])
 	if len(args) > 1 && args[1] == "from_hex" {
 		key, err = hex.DecodeString(args[0])
 		if err != nil {
 			cmd.Printf("Failed to hex.DecodeString: %s\n", err)
-			return
+			return nil
 		}
 	}
-	ekey := codec.EncodeBytes([]byte(key))
-	if v, _ := cmd.Flags().GetBool("base64"); v {
-		cmd.Println(fmt.Sprintf("%s", base64.StdEncoding.EncodeToString(ekey)))
-	} else if v, _ := cmd.Flags().GetBool("url"); v {
-		cmd.Println(fmt.Sprintf("%s", url.QueryEscape(string(ekey))))
-	} else {
-		cmd.Println(fmt.Sprintf("%X", ekey))
-	}
+	cmd.Println(formatOutput(codec.EncodeBytes(key), format))
+	return nil
 }
 
-func decode(cmd *cobra.Command, args []string) {
-	if len(args) != 1 {
-		cmd.Println(cmd.UsageString())
+// encodeTiDB builds a memcomparable TiDB row or index key from its logical
+// components and prints it the same way the plain encode path does, so the
+// result can be fed straight into `keycodec decode --tidb` or used as an
+// affinity scheduler range bound.
+func encodeTiDB(cmd *cobra.Command, args []string, format string) {
+	res := encodeTiDBLine(args, format)
+	if res.Error != "" {
+		cmd.Println("usage: keycodec encode --tidb row <tableID> <handle>")
+		cmd.Println("       keycodec encode --tidb index <tableID> <indexID> <value>...")
+		cmd.Printf("Failed to encode tidb key: %s\n", res.Error)
 		return
 	}
-	var err error
-	var bs []byte
-	if v, _ := cmd.Flags().GetBool("base64"); v {
-		bs, err = base64.StdEncoding.DecodeString(args[0])
+	cmd.Println(res.Out)
+}
+
+// encodeTiDBLine builds a memcomparable TiDB row or index key from fields
+// shaped like ["row", tableID, handle] or ["index", tableID, indexID,
+// value...], carrying any failure in the returned lineResult so it can
+// also drive --batch without aborting the stream.
+func encodeTiDBLine(fields []string, format string) lineResult {
+	if len(fields) < 1 {
+		return lineResult{Error: `want "row <tableID> <handle>" or "index <tableID> <indexID> <value>..."`}
+	}
+
+	var key []byte
+	switch fields[0] {
+	case "row":
+		if len(fields) != 3 {
+			return lineResult{Error: `want "row <tableID> <handle>"`}
+		}
+		tableID, handle, err := parseTiDBInts(fields[1], fields[2])
 		if err != nil {
-			cmd.Printf("Failed to base64 decode: %s\n", err)
-			return
+			return lineResult{Error: err.Error()}
 		}
-		cmd.Println(fmt.Sprintf("hex:%X", string(bs)))
-	} else {
-		bs, err = hex.DecodeString(args[0])
+		key = encodeTiDBRowKey(tableID, handle)
+	case "index":
+		if len(fields) < 3 {
+			return lineResult{Error: `want "index <tableID> <indexID> <value>..."`}
+		}
+		tableID, indexID, err := parseTiDBInts(fields[1], fields[2])
+		if err != nil {
+			return lineResult{Error: err.Error()}
+		}
+		indexKey, err := encodeTiDBIndexKey(tableID, indexID, fields[3:])
 		if err != nil {
-			cmd.Printf("Failed to hex decode: %s\n", err)
-			return
+			return lineResult{Error: err.Error()}
 		}
+		key = indexKey
+	default:
+		return lineResult{Error: fmt.Sprintf("unknown tidb key kind %q, want row or index", fields[0])}
 	}
 
-	l, key, err := codec.DecodeBytes(bs)
+	return lineResult{Out: formatOutput(codec.EncodeBytes(key), format)}
+}
+
+func parseTiDBInts(a, b string) (int64, int64, error) {
+	x, err := strconv.ParseInt(a, 10, 64)
 	if err != nil {
-		cmd.Printf("Failed to DecodeBytes: %s\n", err)
-		return
+		return 0, 0, err
+	}
+	y, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return x, y, nil
+}
+
+func decode(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	format, err := resolveFormat(cmd)
+	if err != nil {
+		cmd.Println(err)
+		return nil
+	}
+	tidb, _ := cmd.Flags().GetBool("tidb")
+
+	if batch, _ := cmd.Flags().GetBool("batch"); batch {
+		asJSON, _ := cmd.Flags().GetBool("json")
+		return runBatch(cmd, cmd.InOrStdin(), asJSON, func(line string) lineResult {
+			return decodeLine(line, format, tidb)
+		})
 	}
 
-	cmd.Println(fmt.Sprintf("key:%s", string(key)))
-	cmd.Println(fmt.Sprintf("left:%X", l))
+	if len(args) != 1 {
+		cmd.Println(cmd.UsageString())
+		return nil
+	}
+	res := decodeLine(args[0], format, tidb)
+	if res.Error != "" {
+		cmd.Printf("Failed to decode: %s\n", res.Error)
+		return nil
+	}
+	if tidb {
+		cmd.Println(res.Out)
+	} else {
+		cmd.Println(fmt.Sprintf("key:%s", res.Out))
+	}
+	cmd.Println(fmt.Sprintf("left:%s", res.Left))
+	return nil
+}
+
+// decodeLine decodes a single input line, never panicking or aborting on
+// error so the caller can keep streaming in --batch mode. Out holds the
+// decoded key (or, with tidb set, the JSON-encoded decoded tidb key) and
+// Left holds the hex-encoded undecoded remainder.
+func decodeLine(line string, format string, tidb bool) lineResult {
+	bs, err := decodeInput(line, format)
+	if err != nil {
+		return lineResult{Error: err.Error()}
+	}
+
+	left, key, err := codec.DecodeBytes(bs)
+	if err != nil {
+		return lineResult{Error: err.Error()}
+	}
+
+	res := lineResult{Out: string(key), Left: fmt.Sprintf("%X", left)}
+	if !tidb {
+		return res
+	}
+
+	decoded, err := decodeTiDBKey(key)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	out, err := json.Marshal(decoded)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Out = string(out)
+	return res
 }
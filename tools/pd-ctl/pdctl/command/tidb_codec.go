@@ -0,0 +1,229 @@
+package command
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// These mirror the key layout TiDB's tablecodec package uses to build row
+// and index keys: a table prefix, a memcomparable table id, a "_r"/"_i"
+// separator and then a memcomparable handle/index id, optionally followed
+// by memcomparable index values.
+const (
+	tidbTablePrefix     = "t"
+	tidbRecordPrefixSep = "_r"
+	tidbIndexPrefixSep  = "_i"
+)
+
+// Value type flags used when walking index values, matching the subset of
+// TiDB's tablecodec flags this tool understands.
+const (
+	tidbNilFlag    byte = 0x00
+	tidbBytesFlag  byte = 0x01
+	tidbIntFlag    byte = 0x03
+	tidbUintFlag   byte = 0x04
+	tidbFloatFlag  byte = 0x05
+	tidbStringFlag byte = 0x07
+)
+
+const signMask uint64 = 1 << 63
+
+// encodeMemComparableInt encodes v the way TiDB encodes table ids,
+// handles and index ids: flip the sign bit, then write big-endian.
+func encodeMemComparableInt(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v)^signMask)
+	return buf
+}
+
+// decodeMemComparableInt reverses encodeMemComparableInt.
+func decodeMemComparableInt(b []byte) (int64, error) {
+	if len(b) < 8 {
+		return 0, fmt.Errorf("insufficient bytes for memcomparable int: %X", b)
+	}
+	u := binary.BigEndian.Uint64(b[:8])
+	return int64(u ^ signMask), nil
+}
+
+// encodeMemComparableFloat encodes f the way TiDB encodes float-typed
+// index columns: non-negative values get their sign bit set, negative
+// values are bit-inverted, then the result is written big-endian. This is
+// a different transform from the int one above because IEEE-754 floats
+// don't order correctly under a plain sign-bit flip.
+func encodeMemComparableFloat(f float64) []byte {
+	u := math.Float64bits(f)
+	if f >= 0 {
+		u |= signMask
+	} else {
+		u = ^u
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf
+}
+
+// decodeMemComparableFloat reverses encodeMemComparableFloat.
+func decodeMemComparableFloat(b []byte) (float64, error) {
+	if len(b) < 8 {
+		return 0, fmt.Errorf("insufficient bytes for memcomparable float: %X", b)
+	}
+	u := binary.BigEndian.Uint64(b[:8])
+	if u&signMask > 0 {
+		u &= ^signMask
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u), nil
+}
+
+// decodeTiDBKey recognizes a TiDB row or index key and decodes its table
+// id, and either its handle or its index id and values.
+func decodeTiDBKey(key []byte) (map[string]interface{}, error) {
+	if len(key) < 9 || key[0] != tidbTablePrefix[0] {
+		return nil, fmt.Errorf("not a tidb table key, want prefix %q", tidbTablePrefix)
+	}
+	tableID, err := decodeMemComparableInt(key[1:9])
+	if err != nil {
+		return nil, err
+	}
+	rest := key[9:]
+
+	switch {
+	case strings.HasPrefix(string(rest), tidbRecordPrefixSep):
+		rest = rest[len(tidbRecordPrefixSep):]
+		handle, err := decodeMemComparableInt(rest)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"tableID": tableID,
+			"kind":    "row",
+			"handle":  handle,
+		}, nil
+	case strings.HasPrefix(string(rest), tidbIndexPrefixSep):
+		rest = rest[len(tidbIndexPrefixSep):]
+		if len(rest) < 8 {
+			return nil, fmt.Errorf("truncated tidb index id: %X", rest)
+		}
+		indexID, err := decodeMemComparableInt(rest[:8])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"tableID":     tableID,
+			"kind":        "index",
+			"indexID":     indexID,
+			"indexValues": decodeIndexValues(rest[8:]),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized tidb key, missing %q/%q separator", tidbRecordPrefixSep, tidbIndexPrefixSep)
+	}
+}
+
+// decodeIndexValues walks a sequence of flagged, memcomparable-encoded
+// index values the same way TiDB's tablecodec does, falling back to hex
+// for anything it doesn't recognize or can't fully consume.
+func decodeIndexValues(b []byte) []interface{} {
+	values := make([]interface{}, 0)
+	for len(b) > 0 {
+		flag := b[0]
+		b = b[1:]
+		switch flag {
+		case tidbNilFlag:
+			values = append(values, nil)
+		case tidbIntFlag, tidbUintFlag, tidbFloatFlag:
+			if len(b) < 8 {
+				values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(b)))
+				return values
+			}
+			raw := b[:8]
+			b = b[8:]
+			switch flag {
+			case tidbIntFlag:
+				v, err := decodeMemComparableInt(raw)
+				if err != nil {
+					values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(raw)))
+					continue
+				}
+				values = append(values, v)
+			case tidbUintFlag:
+				values = append(values, binary.BigEndian.Uint64(raw))
+			case tidbFloatFlag:
+				v, err := decodeMemComparableFloat(raw)
+				if err != nil {
+					values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(raw)))
+					continue
+				}
+				values = append(values, v)
+			}
+		case tidbBytesFlag, tidbStringFlag:
+			if len(b) < 4 {
+				values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(b)))
+				return values
+			}
+			n := binary.BigEndian.Uint32(b[:4])
+			b = b[4:]
+			if uint32(len(b)) < n {
+				values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(b)))
+				return values
+			}
+			data := b[:n]
+			b = b[n:]
+			if flag == tidbStringFlag {
+				values = append(values, string(data))
+			} else {
+				values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(data)))
+			}
+		default:
+			values = append(values, "hex:"+strings.ToUpper(hex.EncodeToString(b)))
+			return values
+		}
+	}
+	return values
+}
+
+// encodeTiDBRowKey builds the memcomparable portion of a TiDB row key for
+// the given table id and handle.
+func encodeTiDBRowKey(tableID, handle int64) []byte {
+	key := append([]byte(tidbTablePrefix), encodeMemComparableInt(tableID)...)
+	key = append(key, tidbRecordPrefixSep...)
+	return append(key, encodeMemComparableInt(handle)...)
+}
+
+// encodeTiDBIndexKey builds the memcomparable portion of a TiDB index key
+// for the given table id, index id and index values. An empty value is
+// encoded as nil; any other value is typed by trying integer, then float,
+// then falling back to string.
+func encodeTiDBIndexKey(tableID, indexID int64, values []string) ([]byte, error) {
+	key := append([]byte(tidbTablePrefix), encodeMemComparableInt(tableID)...)
+	key = append(key, tidbIndexPrefixSep...)
+	key = append(key, encodeMemComparableInt(indexID)...)
+	for _, v := range values {
+		encoded, err := encodeIndexValue(v)
+		if err != nil {
+			return nil, err
+		}
+		key = append(key, encoded...)
+	}
+	return key, nil
+}
+
+func encodeIndexValue(v string) ([]byte, error) {
+	if v == "" {
+		return []byte{tidbNilFlag}, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return append([]byte{tidbIntFlag}, encodeMemComparableInt(n)...), nil
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return append([]byte{tidbFloatFlag}, encodeMemComparableFloat(f)...), nil
+	}
+	lenbuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(lenbuf, uint32(len(v)))
+	buf := append([]byte{tidbStringFlag}, lenbuf...)
+	return append(buf, v...), nil
+}